@@ -1,15 +1,53 @@
 package main
 
 import (
+	"archive/tar"
 	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"net/http"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+const (
+	// defaultDBRepository is the OCI artifact trivy-db itself publishes to.
+	defaultDBRepository = "ghcr.io/aquasecurity/trivy-db"
+
+	// trivyDBLayerMediaType identifies the tar+gzip layer holding trivy.db and metadata.json.
+	trivyDBLayerMediaType = "application/vnd.aquasecurity.trivy-db.layer.v1.tar+gzip"
+
+	// trivyDBTag is the schema-version tag trivy-db publishes its artifacts under.
+	trivyDBTag = "2"
+
+	// defaultJavaDBRepository is the OCI artifact trivy-java-db publishes to.
+	defaultJavaDBRepository = "ghcr.io/aquasecurity/trivy-java-db"
+
+	// javaDBLayerMediaType identifies the tar+gzip layer holding trivy-java.db and metadata.json.
+	javaDBLayerMediaType = "application/vnd.aquasecurity.trivy-java-db.layer.v1.tar+gzip"
+
+	// javaDBTag is the schema-version tag trivy-java-db publishes its artifacts under.
+	javaDBTag = "1"
+
+	// trivyDBRequiredBucket is the top-level bbolt bucket trivy-db always populates.
+	trivyDBRequiredBucket = "trivy"
+
+	// registryRequestTimeout bounds every call to a registry mirror, so that a mirror
+	// which accepts a connection but never responds fails over instead of hanging
+	// runUpdateCycle (and, in --serve mode, the update lock) forever.
+	registryRequestTimeout = 2 * time.Minute
 )
 
 type MetadataJSON struct {
@@ -19,6 +57,25 @@ type MetadataJSON struct {
 	DownloadedAt time.Time `json:"DownloadedAt"`
 }
 
+// ociDescriptor is a content-addressable pointer to a manifest, config or layer blob.
+type ociDescriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
+}
+
+// ociManifest is the subset of the OCI image manifest schema we need to locate the DB layer.
+type ociManifest struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType"`
+	Config        ociDescriptor   `json:"config"`
+	Layers        []ociDescriptor `json:"layers"`
+}
+
+type registryTokenResponse struct {
+	Token string `json:"token"`
+}
+
 func readMetadata(metadataPath string) (*MetadataJSON, error) {
 	file, err := os.ReadFile(metadataPath)
 	if err != nil {
@@ -33,8 +90,9 @@ func readMetadata(metadataPath string) (*MetadataJSON, error) {
 	return &metadata, nil
 }
 
-// copyDir recursively copies a directory tree
-func copyDir(src string, dst string) error {
+// copyDir recursively copies a directory tree. It exists only as moveDir's fallback for
+// when src and dst are on different filesystems and a rename isn't possible.
+func copyDir(src, dst string) error {
 	if err := os.MkdirAll(dst, 0755); err != nil {
 		return err
 	}
@@ -52,43 +110,92 @@ func copyDir(src string, dst string) error {
 			if err := copyDir(srcPath, dstPath); err != nil {
 				return err
 			}
-		} else {
-			srcFile, err := os.Open(srcPath)
-			if err != nil {
-				return err
-			}
-			defer srcFile.Close()
-
-			dstFile, err := os.Create(dstPath)
-			if err != nil {
-				return err
-			}
-			defer dstFile.Close()
+			continue
+		}
 
-			if _, err := io.Copy(dstFile, srcFile); err != nil {
-				return err
-			}
+		if err := copyFile(srcPath, dstPath); err != nil {
+			return err
 		}
 	}
 
 	return nil
 }
 
-func backupTrivyDB(cacheDir string) error {
-	backupDir := "/tmp/trivy_save"
+func copyFile(src, dst string) error {
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+
+	dstFile, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer dstFile.Close()
 
-	os.RemoveAll(backupDir)
+	_, err = io.Copy(dstFile, srcFile)
+	return err
+}
 
-	if err := os.MkdirAll(backupDir, 0755); err != nil {
-		return fmt.Errorf("failed to create backup directory: %v", err)
+// moveDir renames src to dst, falling back to a recursive copy-then-remove when src and
+// dst are on different filesystems (os.Rename returns EXDEV in that case) — this is what
+// lets --backup-dir point at a filesystem other than --cache-dir's.
+func moveDir(src, dst string) error {
+	err := os.Rename(src, dst)
+	if err == nil {
+		return nil
 	}
 
-	if err := copyDir(cacheDir, backupDir); err != nil {
-		return fmt.Errorf("failed to copy directory: %v", err)
+	var linkErr *os.LinkError
+	if !errors.As(err, &linkErr) || linkErr.Err != syscall.EXDEV {
+		return err
 	}
 
-	fmt.Printf("Successfully backed up %s to %s\n", cacheDir, backupDir)
-	return nil
+	if copyErr := copyDir(src, dst); copyErr != nil {
+		return copyErr
+	}
+
+	return os.RemoveAll(src)
+}
+
+// uniqueBackupPath reserves a unique, not-yet-existing path under backupBaseDir for
+// dbDir's backup, so concurrent invocations can't stomp on each other's backups.
+func uniqueBackupPath(backupBaseDir, dbDir string) (string, error) {
+	if err := os.MkdirAll(backupBaseDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create backup base directory: %v", err)
+	}
+
+	tmpDir, err := os.MkdirTemp(backupBaseDir, filepath.Base(dbDir)+".bak.")
+	if err != nil {
+		return "", fmt.Errorf("failed to reserve backup path: %v", err)
+	}
+
+	// MkdirTemp creates the directory to guarantee uniqueness; remove it again so
+	// the rename below can recreate it as an exact copy of dbDir.
+	if err := os.Remove(tmpDir); err != nil {
+		return "", fmt.Errorf("failed to prepare backup path: %v", err)
+	}
+
+	return tmpDir, nil
+}
+
+// backupDBDir atomically renames dbDir (e.g. <cache-dir>/db or <cache-dir>/java-db) to a
+// unique path under backupBaseDir and returns that path, so a failed update can be undone
+// with a single rename back. Each database is backed up independently so that updating
+// one never risks losing the other.
+func backupDBDir(dbDir, backupBaseDir string) (string, error) {
+	backupPath, err := uniqueBackupPath(backupBaseDir, dbDir)
+	if err != nil {
+		return "", err
+	}
+
+	if err := moveDir(dbDir, backupPath); err != nil {
+		return "", fmt.Errorf("failed to move %s to %s: %v", dbDir, backupPath, err)
+	}
+
+	fmt.Printf("Successfully backed up %s to %s\n", dbDir, backupPath)
+	return backupPath, nil
 }
 
 func updateMetadataNextUpdate(metadataPath string) error {
@@ -112,87 +219,655 @@ func updateMetadataNextUpdate(metadataPath string) error {
 	return nil
 }
 
-func restoreTrivyDB(cacheDir string) error {
-	backupDir := "/tmp/trivy_save"
-
-	if err := os.RemoveAll(cacheDir); err != nil {
+// restoreDBDir atomically renames backupPath back over dbDir, undoing a failed update to
+// that single database, and pushes its NextUpdate out so the next scheduled run retries.
+func restoreDBDir(dbDir, backupPath string) error {
+	if err := os.RemoveAll(dbDir); err != nil {
 		return fmt.Errorf("failed to remove current directory: %v", err)
 	}
 
-	if err := copyDir(backupDir, cacheDir); err != nil {
+	if err := moveDir(backupPath, dbDir); err != nil {
 		return fmt.Errorf("failed to restore from backup: %v", err)
 	}
 
-	metadataPath := filepath.Join(cacheDir, "db", "metadata.json")
+	metadataPath := filepath.Join(dbDir, "metadata.json")
 	if err := updateMetadataNextUpdate(metadataPath); err != nil {
 		return fmt.Errorf("failed to update metadata timestamp: %v", err)
 	}
 
-	fmt.Printf("Successfully restored %s from %s\n", cacheDir, backupDir)
+	fmt.Printf("Successfully restored %s from %s\n", dbDir, backupPath)
 	return nil
 }
 
-func runTrivyUpdateCommand(cacheDir string) error {
-	cmd := exec.Command("trivy", "image", "--cache-dir", cacheDir, "--download-db-only")
+// acquireLock takes an advisory exclusive flock on lockPath, creating it if needed, so
+// that concurrent invocations don't race on the same cache directory. If wait is false
+// the call fails immediately when another process already holds the lock.
+func acquireLock(lockPath string, wait bool) (*os.File, error) {
+	lockFile, err := os.OpenFile(lockPath, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file %s: %v", lockPath, err)
+	}
+
+	how := syscall.LOCK_EX
+	if !wait {
+		how |= syscall.LOCK_NB
+	}
+
+	if err := syscall.Flock(int(lockFile.Fd()), how); err != nil {
+		lockFile.Close()
+		return nil, fmt.Errorf("failed to lock %s: %v", lockPath, err)
+	}
+
+	return lockFile, nil
+}
+
+// releaseLock unlocks and closes a file obtained from acquireLock.
+func releaseLock(lockFile *os.File) error {
+	defer lockFile.Close()
+	return syscall.Flock(int(lockFile.Fd()), syscall.LOCK_UN)
+}
+
+// splitRepository splits a "host/path/to/repo" reference into its registry host and
+// repository path, e.g. "ghcr.io/aquasecurity/trivy-db" -> ("ghcr.io", "aquasecurity/trivy-db").
+func splitRepository(repository string) (host string, repoPath string, err error) {
+	parts := strings.SplitN(repository, "/", 2)
+	if len(parts) != 2 {
+		return "", "", fmt.Errorf("invalid repository %q: expected host/path form", repository)
+	}
+	return parts[0], parts[1], nil
+}
+
+// registryHTTPClient is shared by every call to a registry mirror. It carries a fixed
+// timeout so a mirror that accepts a TCP connection but never responds can't hang the
+// caller indefinitely; see registryRequestTimeout.
+var registryHTTPClient = &http.Client{Timeout: registryRequestTimeout}
+
+// fetchRegistryToken obtains an (anonymous, pull-scoped) bearer token for the given
+// registry host and repository path, following the standard docker/OCI distribution
+// auth flow.
+func fetchRegistryToken(host, repoPath string) (string, error) {
+	tokenURL := fmt.Sprintf("https://%s/token?scope=repository:%s:pull&service=%s", host, repoPath, host)
+
+	resp, err := registryHTTPClient.Get(tokenURL)
+	if err != nil {
+		return "", fmt.Errorf("failed to request registry token: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("registry token request returned status %d", resp.StatusCode)
+	}
+
+	var tokenResp registryTokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
+		return "", fmt.Errorf("failed to decode registry token response: %v", err)
+	}
+
+	return tokenResp.Token, nil
+}
+
+// fetchManifest retrieves the OCI image manifest for the given repository and tag.
+func fetchManifest(host, repoPath, tag, token string) (*ociManifest, error) {
+	manifestURL := fmt.Sprintf("https://%s/v2/%s/manifests/%s", host, repoPath, tag)
 
-	var stderr bytes.Buffer
-	cmd.Stderr = &stderr
+	req, err := http.NewRequest(http.MethodGet, manifestURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Accept", "application/vnd.oci.image.manifest.v1+json")
 
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("trivy command failed: %v\nError output:\n%s", err, stderr.String())
+	resp, err := registryHTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch manifest: %v", err)
 	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("manifest request for %s:%s returned status %d", repoPath, tag, resp.StatusCode)
+	}
+
+	var manifest ociManifest
+	if err := json.NewDecoder(resp.Body).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("failed to decode manifest: %v", err)
+	}
+
+	return &manifest, nil
+}
+
+// fetchBlob downloads the blob identified by digest and verifies it against that digest.
+func fetchBlob(host, repoPath, digest, token string) ([]byte, error) {
+	blobURL := fmt.Sprintf("https://%s/v2/%s/blobs/%s", host, repoPath, digest)
+
+	req, err := http.NewRequest(http.MethodGet, blobURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := registryHTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch blob %s: %v", digest, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("blob request for %s returned status %d", digest, resp.StatusCode)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read blob %s: %v", digest, err)
+	}
+
+	if err := verifyDigest(data, digest); err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// verifyDigest checks that data hashes to the "sha256:<hex>" digest string.
+func verifyDigest(data []byte, digest string) error {
+	parts := strings.SplitN(digest, ":", 2)
+	if len(parts) != 2 || parts[0] != "sha256" {
+		return fmt.Errorf("unsupported digest algorithm in %q", digest)
+	}
+
+	sum := sha256.Sum256(data)
+	if got := hex.EncodeToString(sum[:]); got != parts[1] {
+		return fmt.Errorf("digest mismatch: expected %s, got %s", parts[1], got)
+	}
+
 	return nil
 }
 
-func main() {
-	cacheDir := flag.String("cache-dir", "/tmp/trivy", "Directory to store Trivy cache")
-	flag.Parse()
+// safeJoin joins destDir with name the way extractTarGz needs to: it rejects absolute
+// paths and any result that would escape destDir (a zip-slip / path traversal entry),
+// since name comes from a tar archive served by a possibly untrusted mirror.
+func safeJoin(destDir, name string) (string, error) {
+	if filepath.IsAbs(name) {
+		return "", fmt.Errorf("entry path %q is absolute", name)
+	}
+
+	target := filepath.Join(destDir, name)
+
+	destDirWithSep := filepath.Clean(destDir) + string(os.PathSeparator)
+	if target != filepath.Clean(destDir) && !strings.HasPrefix(target, destDirWithSep) {
+		return "", fmt.Errorf("entry path %q escapes %s", name, destDir)
+	}
+
+	return target, nil
+}
+
+// extractTarGz gunzips and untars data into destDir, creating it if necessary.
+func extractTarGz(data []byte, destDir string) error {
+	gzr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("failed to open gzip stream: %v", err)
+	}
+	defer gzr.Close()
+
+	if err := os.MkdirAll(destDir, 0755); err != nil {
+		return fmt.Errorf("failed to create destination directory: %v", err)
+	}
+
+	tr := tar.NewReader(gzr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read tar entry: %v", err)
+		}
+
+		target, err := safeJoin(destDir, hdr.Name)
+		if err != nil {
+			return fmt.Errorf("refusing to extract tar entry %q: %v", hdr.Name, err)
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, os.FileMode(hdr.Mode))
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(f, tr); err != nil {
+				f.Close()
+				return err
+			}
+			f.Close()
+		}
+	}
+}
+
+// downloadDBArtifact fetches the OCI artifact tagged tag from repository, picks out the
+// layer matching layerMediaType and extracts it into destDir. It returns the number of
+// bytes downloaded.
+func downloadDBArtifact(destDir, repository, tag, layerMediaType string) (int64, error) {
+	host, repoPath, err := splitRepository(repository)
+	if err != nil {
+		return 0, err
+	}
+
+	token, err := fetchRegistryToken(host, repoPath)
+	if err != nil {
+		return 0, err
+	}
+
+	manifest, err := fetchManifest(host, repoPath, tag, token)
+	if err != nil {
+		return 0, err
+	}
+
+	var layer *ociDescriptor
+	for i := range manifest.Layers {
+		if manifest.Layers[i].MediaType == layerMediaType {
+			layer = &manifest.Layers[i]
+			break
+		}
+	}
+	if layer == nil {
+		return 0, fmt.Errorf("no %s layer found in manifest for %s", layerMediaType, repository)
+	}
+
+	data, err := fetchBlob(host, repoPath, layer.Digest, token)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := extractTarGz(data, destDir); err != nil {
+		return 0, fmt.Errorf("failed to extract archive from %s: %v", repository, err)
+	}
+
+	fmt.Printf("Downloaded %s from %s (%d bytes)\n", filepath.Base(destDir), repository, len(data))
+	return int64(len(data)), nil
+}
+
+// downloadTrivyDB fetches the trivy-db OCI artifact from repository and extracts
+// trivy.db and metadata.json into <cacheDir>/db/.
+func downloadTrivyDB(cacheDir, repository string) (int64, error) {
+	return downloadDBArtifact(filepath.Join(cacheDir, "db"), repository, trivyDBTag, trivyDBLayerMediaType)
+}
+
+// downloadJavaDB fetches the trivy-java-db OCI artifact from repository and extracts
+// trivy-java.db and metadata.json into <cacheDir>/java-db/.
+func downloadJavaDB(cacheDir, repository string) (int64, error) {
+	return downloadDBArtifact(filepath.Join(cacheDir, "java-db"), repository, javaDBTag, javaDBLayerMediaType)
+}
+
+// tryMirrors calls download with each repository in order, falling back to the next on
+// failure, and only returns an error once every mirror has failed.
+func tryMirrors(repositories []string, download func(repository string) (int64, error)) (int64, error) {
+	var lastErr error
+	for _, repository := range repositories {
+		n, err := download(repository)
+		if err != nil {
+			fmt.Printf("Mirror %s failed: %v\n", repository, err)
+			lastErr = err
+			continue
+		}
+		return n, nil
+	}
+	return 0, fmt.Errorf("all repositories failed, last error: %v", lastErr)
+}
+
+// runTrivyUpdateCommand tries each repository in order, falling back to the next on
+// failure, and only returns an error once every mirror has failed.
+func runTrivyUpdateCommand(cacheDir string, repositories []string) (int64, error) {
+	return tryMirrors(repositories, func(repository string) (int64, error) {
+		return downloadTrivyDB(cacheDir, repository)
+	})
+}
+
+// runJavaDBUpdateCommand tries each repository in order, falling back to the next on
+// failure, and only returns an error once every mirror has failed.
+func runJavaDBUpdateCommand(cacheDir string, repositories []string) (int64, error) {
+	return tryMirrors(repositories, func(repository string) (int64, error) {
+		return downloadJavaDB(cacheDir, repository)
+	})
+}
+
+// dbNeedsUpdate reports whether the database at metadataPath is missing or stale.
+func dbNeedsUpdate(metadataPath string) bool {
+	metadata, err := readMetadata(metadataPath)
+	if err != nil {
+		return true
+	}
+	return time.Now().After(metadata.NextUpdate)
+}
+
+// verifyTrivyDBIntegrity confirms a freshly downloaded trivy.db is actually usable: it
+// must open as a valid bbolt database with the bucket trivy-db always populates, and its
+// metadata.json must report an UpdatedAt newer than the pre-update value. A partial write
+// or a corrupted gzip from a mirror can otherwise look like a successful update.
+func verifyTrivyDBIntegrity(cacheDir string, preUpdateMetadata *MetadataJSON) error {
+	dbPath := filepath.Join(cacheDir, "db", "trivy.db")
+
+	db, err := bbolt.Open(dbPath, 0644, &bbolt.Options{ReadOnly: true, Timeout: 5 * time.Second})
+	if err != nil {
+		return fmt.Errorf("failed to open trivy.db: %v", err)
+	}
+	defer db.Close()
+
+	if err := db.View(func(tx *bbolt.Tx) error {
+		if tx.Bucket([]byte(trivyDBRequiredBucket)) == nil {
+			return fmt.Errorf("required bucket %q is missing", trivyDBRequiredBucket)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	newMetadata, err := readMetadata(filepath.Join(cacheDir, "db", "metadata.json"))
+	if err != nil {
+		return fmt.Errorf("failed to read metadata.json: %v", err)
+	}
+
+	if preUpdateMetadata != nil && !newMetadata.UpdatedAt.After(preUpdateMetadata.UpdatedAt) {
+		return fmt.Errorf("UpdatedAt %s is not newer than pre-update value %s",
+			newMetadata.UpdatedAt.Format(time.RFC3339), preUpdateMetadata.UpdatedAt.Format(time.RFC3339))
+	}
+
+	return nil
+}
+
+// updaterMetrics holds the counters and gauges exposed on /metrics.
+type updaterMetrics struct {
+	mu                 sync.Mutex
+	updateSuccessTotal int64
+	updateFailureTotal int64
+	downloadBytesTotal int64
+	lastUpdateTime     time.Time
+}
+
+func (m *updaterMetrics) recordSuccess(bytesDownloaded int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.updateSuccessTotal++
+	m.downloadBytesTotal += bytesDownloaded
+	m.lastUpdateTime = time.Now()
+}
+
+func (m *updaterMetrics) recordFailure() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.updateFailureTotal++
+}
+
+func (m *updaterMetrics) snapshot() (successTotal, failureTotal, bytesTotal int64, lastUpdateTime time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.updateSuccessTotal, m.updateFailureTotal, m.downloadBytesTotal, m.lastUpdateTime
+}
+
+var updateMetrics = &updaterMetrics{}
+
+// metricsHandler renders updateMetrics and the on-disk DB ages as Prometheus text
+// exposition format.
+func metricsHandler(dbMetadataFile, javaDBMetadataFile string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		successTotal, failureTotal, bytesTotal, lastUpdateTime := updateMetrics.snapshot()
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+		fmt.Fprintln(w, "# HELP trivy_updater_update_success_total Successful DB update runs.")
+		fmt.Fprintln(w, "# TYPE trivy_updater_update_success_total counter")
+		fmt.Fprintf(w, "trivy_updater_update_success_total %d\n", successTotal)
+
+		fmt.Fprintln(w, "# HELP trivy_updater_update_failure_total Failed DB update runs.")
+		fmt.Fprintln(w, "# TYPE trivy_updater_update_failure_total counter")
+		fmt.Fprintf(w, "trivy_updater_update_failure_total %d\n", failureTotal)
+
+		fmt.Fprintln(w, "# HELP trivy_updater_download_bytes_total Bytes downloaded across all DB updates.")
+		fmt.Fprintln(w, "# TYPE trivy_updater_download_bytes_total counter")
+		fmt.Fprintf(w, "trivy_updater_download_bytes_total %d\n", bytesTotal)
+
+		fmt.Fprintln(w, "# HELP trivy_updater_last_update_timestamp_seconds Unix time of the last successful update.")
+		fmt.Fprintln(w, "# TYPE trivy_updater_last_update_timestamp_seconds gauge")
+		if !lastUpdateTime.IsZero() {
+			fmt.Fprintf(w, "trivy_updater_last_update_timestamp_seconds %d\n", lastUpdateTime.Unix())
+		}
+
+		fmt.Fprintln(w, "# HELP trivy_updater_db_age_seconds Age of the on-disk DB.")
+		fmt.Fprintln(w, "# TYPE trivy_updater_db_age_seconds gauge")
+		if metadata, err := readMetadata(dbMetadataFile); err == nil {
+			fmt.Fprintf(w, "trivy_updater_db_age_seconds{db=\"vulnerability\"} %.0f\n", time.Since(metadata.UpdatedAt).Seconds())
+		}
+		if metadata, err := readMetadata(javaDBMetadataFile); err == nil {
+			fmt.Fprintf(w, "trivy_updater_db_age_seconds{db=\"java\"} %.0f\n", time.Since(metadata.UpdatedAt).Seconds())
+		}
+	}
+}
+
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, "ok")
+}
+
+// readyzHandler reports ready once the vulnerability DB has been populated at least once.
+func readyzHandler(dbMetadataFile string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, err := readMetadata(dbMetadataFile); err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintln(w, "vulnerability DB not yet populated")
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintln(w, "ok")
+	}
+}
+
+// sleepUntilNextUpdate blocks until the earliest NextUpdate across the managed
+// databases, with a one-minute floor so a stuck clock can't spin the loop and a
+// one-hour ceiling, which is also the wait when no metadata can be read.
+func sleepUntilNextUpdate(dbMetadataFile, javaDBMetadataFile string, skipJavaDBUpdate bool) {
+	next := time.Now().Add(time.Hour)
+	if metadata, err := readMetadata(dbMetadataFile); err == nil && metadata.NextUpdate.Before(next) {
+		next = metadata.NextUpdate
+	}
+	if !skipJavaDBUpdate {
+		if metadata, err := readMetadata(javaDBMetadataFile); err == nil && metadata.NextUpdate.Before(next) {
+			next = metadata.NextUpdate
+		}
+	}
+
+	wait := time.Until(next)
+	if wait < time.Minute {
+		wait = time.Minute
+	}
 
-	metadataFile := fmt.Sprintf("%s/db/metadata.json", *cacheDir)
-	metadata, err := readMetadata(metadataFile)
+	fmt.Printf("Next update check in %s\n", wait.Round(time.Second))
+	time.Sleep(wait)
+}
+
+// repositoryFlags collects the values of a repeatable repository flag (-db-repository,
+// -java-db-repository) in the order given.
+type repositoryFlags []string
+
+func (r *repositoryFlags) String() string {
+	return strings.Join(*r, ",")
+}
+
+func (r *repositoryFlags) Set(value string) error {
+	*r = append(*r, value)
+	return nil
+}
+
+// runUpdateCycle performs a single read-decide-backup-download-restore pass over the
+// configured databases, recording the outcome in updateMetrics.
+func runUpdateCycle(cacheDir, backupBaseDir string, waitForLock, skipJavaDBUpdate bool, dbRepositories, javaDBRepositories []string) {
+	if err := os.MkdirAll(cacheDir, 0755); err != nil {
+		fmt.Println("Error creating cache directory:", err)
+		return
+	}
+
+	if err := os.MkdirAll(backupBaseDir, 0755); err != nil {
+		fmt.Println("Error creating backup directory:", err)
+		return
+	}
+
+	// The lock lives beside the backups in backupBaseDir rather than inside cacheDir,
+	// named after cacheDir, so runs sharing a cache and backup directory share one lock.
+	lockPath := filepath.Join(backupBaseDir, filepath.Base(cacheDir)+".update.lock")
+	lockFile, err := acquireLock(lockPath, waitForLock)
 	if err != nil {
-		fmt.Println("Error reading metadata.json:", err)
-		fmt.Println("Executing Trivy DB download...")
-		if err := backupTrivyDB(*cacheDir); err != nil {
+		if !waitForLock {
+			fmt.Println("Another trivy-db-updater instance is already updating, exiting.")
+			return
+		}
+		fmt.Println("Error acquiring update lock:", err)
+		return
+	}
+	defer releaseLock(lockFile)
+
+	dbDir := filepath.Join(cacheDir, "db")
+	javaDBDir := filepath.Join(cacheDir, "java-db")
+	dbMetadataFile := filepath.Join(dbDir, "metadata.json")
+	javaDBMetadataFile := filepath.Join(javaDBDir, "metadata.json")
+
+	updateDB := dbNeedsUpdate(dbMetadataFile)
+	updateJavaDB := !skipJavaDBUpdate && dbNeedsUpdate(javaDBMetadataFile)
+
+	if !updateDB && !updateJavaDB {
+		fmt.Println("Trivy DB is up-to-date. No update needed.")
+		if metadata, err := readMetadata(dbMetadataFile); err == nil {
+			fmt.Printf("Next Trivy DB update will happen at: %s\n", metadata.NextUpdate.Format(time.RFC3339))
+		}
+		return
+	}
+
+	// Each database is backed up and restored independently so that refreshing one
+	// never risks losing the other: only the stale one's directory is ever touched.
+	var bytesDownloaded int64
+
+	if updateDB {
+		fmt.Println("Updating Trivy DB...")
+		preUpdateMetadata, _ := readMetadata(dbMetadataFile)
+
+		backupPath, err := backupDBDir(dbDir, backupBaseDir)
+		if err != nil {
 			fmt.Println("Error backing up Trivy DB:", err)
+			updateMetrics.recordFailure()
 			return
 		}
-		if err := runTrivyUpdateCommand(*cacheDir); err != nil {
-			fmt.Println(err)
+
+		n, err := runTrivyUpdateCommand(cacheDir, dbRepositories)
+		if err == nil {
+			if verifyErr := verifyTrivyDBIntegrity(cacheDir, preUpdateMetadata); verifyErr != nil {
+				err = fmt.Errorf("vulnerability DB integrity check failed: %v", verifyErr)
+			}
+		}
+		if err != nil {
+			fmt.Println("Vulnerability DB update failed:", err)
 			fmt.Println("Update failed, restoring from backup...")
-			if restoreErr := restoreTrivyDB(*cacheDir); restoreErr != nil {
+			if restoreErr := restoreDBDir(dbDir, backupPath); restoreErr != nil {
 				fmt.Printf("Error restoring from backup: %v\n", restoreErr)
 			}
+			updateMetrics.recordFailure()
 			return
 		}
-		// Read the new metadata after update
-		if newMetadata, err := readMetadata(metadataFile); err == nil {
-			fmt.Printf("Next Trivy DB update will happen at: %s\n", newMetadata.NextUpdate.Format(time.RFC3339))
+
+		if err := os.RemoveAll(backupPath); err != nil {
+			fmt.Printf("Warning: failed to remove old backup %s: %v\n", backupPath, err)
 		}
-		return
+		bytesDownloaded += n
 	}
 
-	if time.Now().After(metadata.NextUpdate) {
-		fmt.Println("Updating Trivy DB...")
-		if err := backupTrivyDB(*cacheDir); err != nil {
-			fmt.Println("Error backing up Trivy DB:", err)
+	if updateJavaDB {
+		fmt.Println("Updating Trivy Java DB...")
+		backupPath, err := backupDBDir(javaDBDir, backupBaseDir)
+		if err != nil {
+			fmt.Println("Error backing up Trivy Java DB:", err)
+			updateMetrics.recordFailure()
 			return
 		}
-		if err := runTrivyUpdateCommand(*cacheDir); err != nil {
-			fmt.Println(err)
+
+		n, err := runJavaDBUpdateCommand(cacheDir, javaDBRepositories)
+		if err != nil {
+			fmt.Println("Java DB update failed:", err)
 			fmt.Println("Update failed, restoring from backup...")
-			if restoreErr := restoreTrivyDB(*cacheDir); restoreErr != nil {
+			if restoreErr := restoreDBDir(javaDBDir, backupPath); restoreErr != nil {
 				fmt.Printf("Error restoring from backup: %v\n", restoreErr)
 			}
+			updateMetrics.recordFailure()
 			return
 		}
-		fmt.Println("Trivy DB update complete.")
-		// Read the new metadata after update
-		if newMetadata, err := readMetadata(metadataFile); err == nil {
-			fmt.Printf("Next Trivy DB update will happen at: %s\n", newMetadata.NextUpdate.Format(time.RFC3339))
+
+		if err := os.RemoveAll(backupPath); err != nil {
+			fmt.Printf("Warning: failed to remove old backup %s: %v\n", backupPath, err)
 		}
-	} else {
-		fmt.Println("Trivy DB is up-to-date. No update needed.")
+		bytesDownloaded += n
+	}
+
+	updateMetrics.recordSuccess(bytesDownloaded)
+
+	fmt.Println("Trivy DB update complete.")
+	if metadata, err := readMetadata(dbMetadataFile); err == nil {
 		fmt.Printf("Next Trivy DB update will happen at: %s\n", metadata.NextUpdate.Format(time.RFC3339))
 	}
+	if !skipJavaDBUpdate {
+		if metadata, err := readMetadata(javaDBMetadataFile); err == nil {
+			fmt.Printf("Next Trivy Java DB update will happen at: %s\n", metadata.NextUpdate.Format(time.RFC3339))
+		}
+	}
+}
+
+func main() {
+	cacheDir := flag.String("cache-dir", "/tmp/trivy", "Directory to store Trivy cache")
+	backupDir := flag.String("backup-dir", "", "Directory to hold the cache backup during updates (defaults to the cache directory's parent, so the backup stays on the same filesystem for an atomic rename)")
+	waitForLock := flag.Bool("wait-for-lock", true, "Block until the update lock is available instead of exiting immediately if another instance is already updating")
+	skipJavaDBUpdate := flag.Bool("skip-java-db-update", false, "Skip updating the Trivy Java DB")
+	serve := flag.Bool("serve", false, "Run as a daemon, updating on schedule and exposing /metrics, /healthz and /readyz")
+	listenAddress := flag.String("listen-address", ":8080", "Address to serve /metrics, /healthz and /readyz on in --serve mode")
+	var dbRepositories repositoryFlags
+	flag.Var(&dbRepositories, "db-repository", "OCI repository to pull the Trivy DB from (repeatable; tried in order until one succeeds)")
+	var javaDBRepositories repositoryFlags
+	flag.Var(&javaDBRepositories, "java-db-repository", "OCI repository to pull the Trivy Java DB from (repeatable; tried in order until one succeeds)")
+	flag.Parse()
+
+	if len(dbRepositories) == 0 {
+		dbRepositories = repositoryFlags{defaultDBRepository}
+	}
+	if len(javaDBRepositories) == 0 {
+		javaDBRepositories = repositoryFlags{defaultJavaDBRepository}
+	}
+
+	backupBaseDir := *backupDir
+	if backupBaseDir == "" {
+		backupBaseDir = filepath.Dir(*cacheDir)
+	}
+
+	if !*serve {
+		runUpdateCycle(*cacheDir, backupBaseDir, *waitForLock, *skipJavaDBUpdate, dbRepositories, javaDBRepositories)
+		return
+	}
+
+	dbMetadataFile := filepath.Join(*cacheDir, "db", "metadata.json")
+	javaDBMetadataFile := filepath.Join(*cacheDir, "java-db", "metadata.json")
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metricsHandler(dbMetadataFile, javaDBMetadataFile))
+	mux.HandleFunc("/healthz", healthzHandler)
+	mux.HandleFunc("/readyz", readyzHandler(dbMetadataFile))
+
+	go func() {
+		fmt.Printf("Serving /metrics, /healthz and /readyz on %s\n", *listenAddress)
+		if err := http.ListenAndServe(*listenAddress, mux); err != nil {
+			fmt.Println("Metrics server error:", err)
+		}
+	}()
+
+	for {
+		runUpdateCycle(*cacheDir, backupBaseDir, *waitForLock, *skipJavaDBUpdate, dbRepositories, javaDBRepositories)
+		sleepUntilNextUpdate(dbMetadataFile, javaDBMetadataFile, *skipJavaDBUpdate)
+	}
 }
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+)
+
+func TestSafeJoin(t *testing.T) {
+	destDir := "/cache/db"
+
+	valid := []string{
+		"trivy.db",
+		"metadata.json",
+		"nested/file.txt",
+		".",
+	}
+	for _, name := range valid {
+		if _, err := safeJoin(destDir, name); err != nil {
+			t.Errorf("safeJoin(%q, %q) returned unexpected error: %v", destDir, name, err)
+		}
+	}
+
+	invalid := []string{
+		"/etc/passwd",
+		"../escape.txt",
+		"nested/../../escape.txt",
+		"../../../etc/passwd",
+	}
+	for _, name := range invalid {
+		if _, err := safeJoin(destDir, name); err == nil {
+			t.Errorf("safeJoin(%q, %q) expected an error, got nil", destDir, name)
+		}
+	}
+}
+
+func TestVerifyDigest(t *testing.T) {
+	data := []byte("trivy-db contents")
+	sum := sha256.Sum256(data)
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+
+	if err := verifyDigest(data, digest); err != nil {
+		t.Errorf("verifyDigest with a matching digest returned an error: %v", err)
+	}
+
+	if err := verifyDigest([]byte("tampered contents"), digest); err == nil {
+		t.Error("verifyDigest with a mismatched digest expected an error, got nil")
+	}
+
+	if err := verifyDigest(data, "md5:"+hex.EncodeToString(sum[:])); err == nil {
+		t.Error("verifyDigest with an unsupported algorithm expected an error, got nil")
+	}
+
+	if err := verifyDigest(data, "sha256:notahexdigest"); err == nil {
+		t.Error("verifyDigest with a malformed digest expected an error, got nil")
+	}
+}